@@ -2,12 +2,14 @@ package core
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/mitchellh/mapstructure"
 )
 
@@ -27,8 +29,98 @@ var (
 		"artifactsLocation": os.TempDir(),
 		"cacheDirectory":    expandHome("~/.cache/ngbuild/"),
 	}
+
+	configWatcherOnce sync.Once
+	configWatcher     *fsnotify.Watcher
+	watchedConfigDirs = make(map[string]bool)
+
+	configSubsLock    sync.Mutex
+	configSubscribers []func(path string)
 )
 
+// OnConfigReloaded registers fn to be called, with the config path
+// (relative to configBaseDir) that changed, whenever a loaded config file
+// is modified on disk. Integrations use this to re-apply their config
+// without requiring ngbuild to restart.
+func OnConfigReloaded(fn func(path string)) {
+	configSubsLock.Lock()
+	defer configSubsLock.Unlock()
+	configSubscribers = append(configSubscribers, fn)
+}
+
+// watchConfigDir lazily starts a single fsnotify watcher rooted at whatever
+// config directories loadConfig has actually been asked to read, and adds
+// dir to it if it isn't already watched.
+func watchConfigDir(dir string) {
+	configWatcherOnce.Do(func() {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			fmt.Printf("core: couldn't start config watcher, config changes will require a restart: %s\n", err)
+			return
+		}
+		configWatcher = watcher
+		go watchConfigEvents(watcher)
+	})
+
+	if configWatcher == nil {
+		return
+	}
+
+	configCacheLock.Lock()
+	defer configCacheLock.Unlock()
+	if watchedConfigDirs[dir] {
+		return
+	}
+	if err := configWatcher.Add(dir); err == nil {
+		watchedConfigDirs[dir] = true
+	}
+}
+
+func watchConfigEvents(watcher *fsnotify.Watcher) {
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if ok == false {
+				return
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+				onConfigFileChanged(event.Name)
+			}
+		case _, ok := <-watcher.Errors:
+			if ok == false {
+				return
+			}
+		}
+	}
+}
+
+// onConfigFileChanged invalidates the cache entry for the config file at
+// fullPath and, only if there was one, notifies every subscriber registered
+// via OnConfigReloaded. Changes to files that aren't cached are ignored.
+func onConfigFileChanged(fullPath string) {
+	path, err := filepath.Rel(configBaseDir, fullPath)
+	if err != nil {
+		path = fullPath
+	}
+
+	configCacheLock.Lock()
+	_, cached := configCache[path]
+	delete(configCache, path)
+	configCacheLock.Unlock()
+
+	if cached == false {
+		return
+	}
+
+	configSubsLock.Lock()
+	subscribers := append([]func(path string){}, configSubscribers...)
+	configSubsLock.Unlock()
+
+	for _, subscriber := range subscribers {
+		subscriber(path)
+	}
+}
+
 func loadConfig(path string) (config, error) {
 	configCacheLock.RLock()
 	var err error
@@ -45,7 +137,8 @@ func loadConfig(path string) (config, error) {
 	}
 	configCacheLock.RUnlock()
 
-	raw, err := ioutil.ReadFile(filepath.Join(configBaseDir, path))
+	fullPath := filepath.Join(configBaseDir, path)
+	raw, err := ioutil.ReadFile(fullPath)
 	if err != nil {
 		return nil, err
 	}
@@ -57,8 +150,10 @@ func loadConfig(path string) (config, error) {
 	}
 
 	configCacheLock.Lock()
-	defer configCacheLock.Unlock()
 	configCache[path] = (config)(conf.(map[string]interface{}))
+	configCacheLock.Unlock()
+
+	watchConfigDir(filepath.Dir(fullPath))
 
 	return configCache[path], nil
 }
@@ -71,19 +166,25 @@ func loadAppConfig(appname string) (config, error) {
 	return loadConfig(filepath.Join("apps", appname, "config.json"))
 }
 
-// for the given config, apply it's data onto the given structure s
+// applyConfig decodes defaults, then ngbuild.json, then (if appname is set)
+// apps/<appname>/config.json onto s, in that order. Every layer is decoded
+// strictly via decodeStrict: unknown keys are rejected and no implicit type
+// coercion is attempted, so a typo in a config file is a loud error instead
+// of a silently-zeroed field. Errors from every layer are aggregated, so a
+// bad master config and a bad app config are both reported at once.
 func applyConfig(appname string, s interface{}) error {
-	if err := mapstructure.Decode(configDefaults, s); err != nil {
-		return err
+	var errs []string
+
+	if err := decodeStrict(configDefaults, s); err != nil {
+		errs = append(errs, fmt.Sprintf("defaults: %s", err))
 	}
 
 	master, err := loadMasterConfig()
 	if err != nil {
 		return err
 	}
-
-	if err = mapstructure.Decode(master, s); err != nil {
-		return err
+	if err := decodeStrict(master, s); err != nil {
+		errs = append(errs, fmt.Sprintf("ngbuild.json: %s", err))
 	}
 
 	if appname != "" {
@@ -91,8 +192,13 @@ func applyConfig(appname string, s interface{}) error {
 		if err != nil {
 			return err
 		}
+		if err := decodeStrict(appconfig, s); err != nil {
+			errs = append(errs, fmt.Sprintf("apps/%s/config.json: %s", appname, err))
+		}
+	}
 
-		return mapstructure.Decode(appconfig, s)
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration for %q:\n%s", appname, strings.Join(errs, "\n"))
 	}
 	return nil
 }
@@ -111,16 +217,33 @@ func getIntegrationConfig(conf config, integrationName string) config {
 	}
 }
 
+// decodeStrict applies raw onto s, the decoding applyConfig and
+// applyIntegrationConfig use for every layer. It rejects keys in raw that
+// don't map onto a field of s and never coerces between types, so a typo in
+// a config file is a loud error instead of a silently-zeroed field.
+func decodeStrict(raw interface{}, s interface{}) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		ErrorUnused:      true,
+		WeaklyTypedInput: false,
+		Result:           s,
+	})
+	if err != nil {
+		return err
+	}
+	return decoder.Decode(raw)
+}
+
 // Like applyConfig, but will look for configs in /integrations/integrationName/
 func applyIntegrationConfig(appname, integrationName string, s interface{}) error {
+	var errs []string
+
 	master, err := loadMasterConfig()
 	if err != nil {
 		return err
 	}
-
 	if masterIntegration := getIntegrationConfig(master, integrationName); masterIntegration != nil {
-		if err = mapstructure.Decode(masterIntegration, s); err != nil {
-			return err
+		if err := decodeStrict(masterIntegration, s); err != nil {
+			errs = append(errs, fmt.Sprintf("ngbuild.json integrations.%s: %s", integrationName, err))
 		}
 	}
 
@@ -129,13 +252,15 @@ func applyIntegrationConfig(appname, integrationName string, s interface{}) erro
 		if err != nil {
 			return err
 		}
-
 		if appIntegration := getIntegrationConfig(appconfig, integrationName); appIntegration != nil {
-			if err = mapstructure.Decode(appIntegration, s); err != nil {
-				return err
+			if err := decodeStrict(appIntegration, s); err != nil {
+				errs = append(errs, fmt.Sprintf("apps/%s/config.json integrations.%s: %s", appname, integrationName, err))
 			}
 		}
 	}
 
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid %q configuration for %q:\n%s", integrationName, appname, strings.Join(errs, "\n"))
+	}
 	return nil
 }
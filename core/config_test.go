@@ -0,0 +1,111 @@
+package core
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type decodeStrictTarget struct {
+	Name  string `mapstructure:"name"`
+	Count int    `mapstructure:"count"`
+}
+
+func TestDecodeStrict(t *testing.T) {
+	t.Run("valid input decodes cleanly", func(t *testing.T) {
+		var target decodeStrictTarget
+		raw := config{"name": "a", "count": 5}
+		if err := decodeStrict(raw, &target); err != nil {
+			t.Fatalf("decodeStrict: %s", err)
+		}
+		if target.Name != "a" || target.Count != 5 {
+			t.Errorf("decoded target = %+v, want {Name:a Count:5}", target)
+		}
+	})
+
+	t.Run("rejects unknown keys", func(t *testing.T) {
+		var target decodeStrictTarget
+		raw := config{"name": "a", "bogus": "x"}
+		if err := decodeStrict(raw, &target); err == nil {
+			t.Fatal("expected an error for an unknown key, got nil")
+		}
+	})
+
+	t.Run("rejects type mismatches instead of coercing", func(t *testing.T) {
+		var target decodeStrictTarget
+		raw := config{"name": "a", "count": "5"}
+		if err := decodeStrict(raw, &target); err == nil {
+			t.Fatal("expected an error for a string value in an int field, got nil")
+		}
+	})
+}
+
+// withConfigCache stashes entries directly in configCache, bypassing
+// loadConfig's filesystem read, and clears them afterwards.
+func withConfigCache(t *testing.T, entries map[string]config, fn func()) {
+	t.Helper()
+
+	configCacheLock.Lock()
+	for path, c := range entries {
+		configCache[path] = c
+	}
+	configCacheLock.Unlock()
+
+	defer func() {
+		configCacheLock.Lock()
+		for path := range entries {
+			delete(configCache, path)
+		}
+		configCacheLock.Unlock()
+	}()
+
+	fn()
+}
+
+type applyConfigTarget struct {
+	BuildLocation     string `mapstructure:"buildLocation"`
+	ArtifactsLocation string `mapstructure:"artifactsLocation"`
+	CacheDirectory    string `mapstructure:"cacheDirectory"`
+	Count             int    `mapstructure:"count"`
+}
+
+func TestApplyConfigAggregatesErrorsAcrossLayers(t *testing.T) {
+	appname := "testapp"
+	appConfigPath := filepath.Join("apps", appname, "config.json")
+
+	withConfigCache(t, map[string]config{
+		"ngbuild.json": {"bogus": "unknown to ngbuild.json"},
+		appConfigPath:  {"count": "not-a-number"},
+	}, func() {
+		var target applyConfigTarget
+		err := applyConfig(appname, &target)
+		if err == nil {
+			t.Fatal("expected an aggregated error, got nil")
+		}
+
+		if strings.Contains(err.Error(), "ngbuild.json:") == false {
+			t.Errorf("error doesn't mention the ngbuild.json layer: %s", err)
+		}
+		if strings.Contains(err.Error(), appConfigPath+":") == false {
+			t.Errorf("error doesn't mention the %s layer: %s", appConfigPath, err)
+		}
+	})
+}
+
+func TestApplyConfigSucceedsWithValidLayers(t *testing.T) {
+	appname := "testapp"
+	appConfigPath := filepath.Join("apps", appname, "config.json")
+
+	withConfigCache(t, map[string]config{
+		"ngbuild.json": {},
+		appConfigPath:  {"count": 3},
+	}, func() {
+		var target applyConfigTarget
+		if err := applyConfig(appname, &target); err != nil {
+			t.Fatalf("applyConfig: %s", err)
+		}
+		if target.Count != 3 {
+			t.Errorf("target.Count = %d, want 3", target.Count)
+		}
+	})
+}
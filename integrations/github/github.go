@@ -1,11 +1,23 @@
 package github
 
 import (
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -14,18 +26,32 @@ import (
 	"golang.org/x/oauth2"
 	githubO2 "golang.org/x/oauth2/github"
 
+	"github.com/dgrijalva/jwt-go"
 	"github.com/google/go-github/github"
 	"github.com/watchly/ngbuild/core"
 )
 
+// installationTokenRefreshSkew is how long before an installation token's
+// expiry we proactively mint a replacement.
+const installationTokenRefreshSkew = 5 * time.Minute
+
+// jwtExpiry is how long a GitHub App JWT is valid for. Github caps this at
+// 10 minutes; we use less to leave room for clock drift.
+const jwtExpiry = 9 * time.Minute
+
 var oauth2State = fmt.Sprintf("%d%d%d", os.Getuid(), os.Getpid(), time.Now().Unix())
 
 type pullRequestStatus struct {
-	pull         *github.PullRequest
-	currentBuild string // build token
-	mergeOnPass  bool
+	pull            *github.PullRequest
+	currentBuild    string // build token
+	mergeOnPass     bool
+	statusCommentID int // sticky failure comment, 0 if none posted yet
 }
 
+// buildLogTailLines is how many trailing lines of a failed build's log to
+// include in the PR comment we post.
+const buildLogTailLines = 40
+
 type githubConfig struct {
 	ClientID     string `mapstructure:"clientID"`
 	ClientSecret string `mapstructure:"clientSecret"`
@@ -39,11 +65,105 @@ type githubConfig struct {
 	CancelOnNewCommit    bool     `mapstructure:"cancelOnNewCommit"`
 	MergeOnPass          bool     `mapstructure:"mergeOnPass"`
 	MergeOnPassAuthWords []string `mapstructure:"mergeOnPassAuthWords"`
+
+	// AppID, InstallationID and PrivateKeyPath select GitHub App
+	// (installation token) authentication instead of the global OAuth2
+	// flow. When all three are set this app mints its own short-lived
+	// installation token, scoped to InstallationID, and is free to point
+	// at a different installation (and therefore a different org) than
+	// other apps sharing this integration.
+	AppID          int64  `mapstructure:"appID"`
+	InstallationID int64  `mapstructure:"installationID"`
+	PrivateKeyPath string `mapstructure:"privateKeyPath"`
+
+	// URL, APIURL and UploadURL point this integration at a GitHub
+	// Enterprise / self-hosted instance instead of github.com. URL is the
+	// user-facing base (e.g. "https://ghe.example.com/"); APIURL and
+	// UploadURL default to URL+"api/v3/" and URL+"api/uploads/"
+	// respectively, matching go-github's own conventions, and only need
+	// to be set if the instance deviates from that layout.
+	URL        string `mapstructure:"url"`
+	APIURL     string `mapstructure:"apiURL"`
+	UploadURL  string `mapstructure:"uploadURL"`
+	SkipVerify bool   `mapstructure:"skipVerify"`
+
+	// WebhookSecret, when set, is the secret configured on this app's
+	// GitHub webhook; incoming deliveries that don't carry a matching
+	// X-Hub-Signature-256 are rejected.
+	WebhookSecret string `mapstructure:"webhookSecret"`
+}
+
+// isEnterprise reports whether this config points at a GitHub Enterprise
+// instance rather than github.com.
+func (c githubConfig) isEnterprise() bool {
+	return c.URL != ""
+}
+
+// apiBaseURL returns the base URL API calls (including installation token
+// minting) should be made against.
+func (c githubConfig) apiBaseURL() string {
+	if c.APIURL != "" {
+		return strings.TrimSuffix(c.APIURL, "/")
+	}
+	if c.isEnterprise() {
+		return strings.TrimSuffix(c.URL, "/") + "/api/v3"
+	}
+	return "https://api.github.com"
+}
+
+// uploadBaseURL returns the base URL release asset uploads should be made
+// against.
+func (c githubConfig) uploadBaseURL() string {
+	if c.UploadURL != "" {
+		return strings.TrimSuffix(c.UploadURL, "/")
+	}
+	if c.isEnterprise() {
+		return strings.TrimSuffix(c.URL, "/") + "/api/uploads"
+	}
+	return "https://uploads.github.com"
+}
+
+// httpClient builds the *http.Client API and OAuth2 requests for this
+// config should be issued through, honouring SkipVerify for self-signed GHE
+// deployments.
+func (c githubConfig) httpClient() *http.Client {
+	if c.SkipVerify == false {
+		return http.DefaultClient
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+}
+
+// usesAppAuth reports whether this config should authenticate as a GitHub
+// App installation rather than through the shared OAuth2 user token.
+func (c githubConfig) usesAppAuth() bool {
+	return c.AppID != 0 && c.InstallationID != 0 && c.PrivateKeyPath != ""
 }
 
 type githubApp struct {
 	app    core.App
 	config githubConfig
+
+	// clientMu guards client, installationExpiry and installationRefresh,
+	// which are written both under AttachToApp/onConfigReloaded and from
+	// the installation token refresh timer's own goroutine.
+	clientMu sync.RWMutex
+	// client is set when this app authenticates as its own GitHub App
+	// installation. Left nil for apps sharing the global OAuth2 client.
+	client              *github.Client
+	installationExpiry  time.Time
+	installationRefresh *time.Timer
+}
+
+// getClient returns the app's own installation client, or nil if it hasn't
+// authenticated as a GitHub App installation.
+func (a *githubApp) getClient() *github.Client {
+	a.clientMu.RLock()
+	defer a.clientMu.RUnlock()
+	return a.client
 }
 
 // Github ...
@@ -55,15 +175,72 @@ type Github struct {
 	client                 *github.Client
 	clientID, clientSecret string
 	clientHasSet           *sync.Cond
+	// clientErr is set, alongside a Broadcast on clientHasSet, when
+	// setClient fails to build a client (e.g. a malformed Enterprise URL),
+	// so init's wait loop can fail startup loudly instead of waiting
+	// forever for a client that will never arrive.
+	clientErr error
 
 	trackedPullRequests map[string]pullRequestStatus
 	trackedBuilds       []core.Build
+
+	// agitBuilds maps an agit build group (see handlePushEvent) to the
+	// token of its most recent build, so a later push to the same
+	// pusher+topic+target can find and cancel it.
+	agitBuilds map[string]string
+
+	// recentDeliveries remembers recently-seen X-GitHub-Delivery IDs so a
+	// retried webhook delivery isn't processed twice.
+	recentDeliveries *deliveryLRU
+}
+
+// recentDeliveryLimit bounds how many X-GitHub-Delivery IDs are remembered
+// for de-duplicating retried webhook deliveries.
+const recentDeliveryLimit = 512
+
+// deliveryLRU is a fixed-size, insertion-order set used to recognize
+// webhook deliveries ngbuild has already processed.
+type deliveryLRU struct {
+	mu    sync.Mutex
+	limit int
+	order []string
+	seen  map[string]bool
+}
+
+func newDeliveryLRU(limit int) *deliveryLRU {
+	return &deliveryLRU{limit: limit, seen: make(map[string]bool)}
+}
+
+// seenBefore reports whether id has already been recorded, recording it if
+// not. An empty id (no X-GitHub-Delivery header) is never considered seen.
+func (l *deliveryLRU) seenBefore(id string) bool {
+	if id == "" {
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.seen[id] {
+		return true
+	}
+
+	l.seen[id] = true
+	l.order = append(l.order, id)
+	if len(l.order) > l.limit {
+		oldest := l.order[0]
+		l.order = l.order[1:]
+		delete(l.seen, oldest)
+	}
+	return false
 }
 
 // New ...
 func New() *Github {
 	g := &Github{
 		clientHasSet:        sync.NewCond(&sync.Mutex{}),
+		agitBuilds:          make(map[string]string),
+		recentDeliveries:    newDeliveryLRU(recentDeliveryLimit),
 		apps:                make(map[string]*githubApp),
 		trackedPullRequests: make(map[string]pullRequestStatus),
 	}
@@ -99,48 +276,199 @@ func (g *Github) handleGithubAuth(resp http.ResponseWriter, req *http.Request) {
 	code := q.Get("code")
 	cfg := g.getOauthConfig()
 
-	token, err := cfg.Exchange(context.Background(), code)
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, g.globalConfig.httpClient())
+	token, err := cfg.Exchange(ctx, code)
 	if err != nil {
 		resp.Write([]byte("Error exchanging OAuth code, something bad happened between Github and us: " + err.Error()))
 		return
 	}
 
 	core.StoreCache("github:token", token.AccessToken)
-	g.setClient(token)
+	if err := g.setClient(token); err != nil {
+		resp.Write([]byte("Error building github client, something bad happened between Github and us: " + err.Error()))
+		return
+	}
 
 	resp.Write([]byte("Thanks! you can close this tab now."))
 }
 
 func (g *Github) getOauthConfig() *oauth2.Config {
+	endpoint := githubO2.Endpoint
+	if g.globalConfig.isEnterprise() {
+		base := strings.TrimSuffix(g.globalConfig.URL, "/")
+		endpoint = oauth2.Endpoint{
+			AuthURL:  base + "/login/oauth/authorize",
+			TokenURL: base + "/login/oauth/access_token",
+		}
+	}
+
 	return &oauth2.Config{
 		ClientID:     g.globalConfig.ClientID,
 		ClientSecret: g.globalConfig.ClientSecret,
-		Endpoint:     githubO2.Endpoint,
+		Endpoint:     endpoint,
 		Scopes:       []string{"repo"},
 	}
 }
 
-func (g *Github) setClient(token *oauth2.Token) {
-	ts := g.getOauthConfig().TokenSource(oauth2.NoContext, token)
-	tc := oauth2.NewClient(oauth2.NoContext, ts)
-
-	g.client = github.NewClient(tc)
+// setClient builds the shared OAuth2 client from token and stores it,
+// waking any goroutine blocked in init's wait loop. If building the client
+// fails (e.g. a malformed Enterprise URL), the error is stored in
+// g.clientErr and returned instead, so a caller can fail loudly rather than
+// leave init waiting for a client that will never arrive.
+func (g *Github) setClient(token *oauth2.Token) error {
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, g.globalConfig.httpClient())
+	ts := g.getOauthConfig().TokenSource(ctx, token)
+	tc := oauth2.NewClient(ctx, ts)
+
+	if g.globalConfig.isEnterprise() {
+		client, err := github.NewEnterpriseClient(g.globalConfig.apiBaseURL(), g.globalConfig.uploadBaseURL(), tc)
+		if err != nil {
+			err = fmt.Errorf("couldn't build enterprise client for %s: %s", g.globalConfig.URL, err)
+			logcritf(err.Error())
+			g.clientErr = err
+			g.clientHasSet.Broadcast()
+			return err
+		}
+		g.client = client
+	} else {
+		g.client = github.NewClient(tc)
+	}
 	g.clientHasSet.Broadcast()
+	return nil
 }
 
-func (g *Github) acquireOauthToken() {
+func (g *Github) acquireOauthToken() error {
 	token := core.GetCache("github:token")
 
 	if token != "" {
 		oauth2Token := oauth2.Token{AccessToken: token}
-		g.setClient(&oauth2Token)
-		return
+		return g.setClient(&oauth2Token)
 	}
 
 	fmt.Println("")
 	fmt.Println("This app must be authenticated with github, please visit the following URL to authenticate this app")
 	fmt.Println(g.getOauthConfig().AuthCodeURL(oauth2State, oauth2.AccessTypeOffline))
 	fmt.Println("")
+	return nil
+}
+
+// signedAppJWT builds and signs a JWT identifying the GitHub App cfg.AppID,
+// as required to authenticate calls that mint installation tokens.
+func signedAppJWT(cfg githubConfig) (string, error) {
+	keyPEM, err := ioutil.ReadFile(cfg.PrivateKeyPath)
+	if err != nil {
+		return "", fmt.Errorf("couldn't read app private key: %s", err)
+	}
+
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return "", errors.New("privateKeyPath does not contain a PEM block")
+	}
+
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		var genericKey interface{}
+		if genericKey, err = x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+			return "", fmt.Errorf("couldn't parse app private key: %s", err)
+		}
+		var ok bool
+		if key, ok = genericKey.(*rsa.PrivateKey); ok == false {
+			return "", errors.New("app private key is not an RSA key")
+		}
+	}
+
+	now := time.Now()
+	claims := jwt.StandardClaims{
+		IssuedAt:  now.Add(-time.Minute).Unix(), // allow for clock drift
+		ExpiresAt: now.Add(jwtExpiry).Unix(),
+		Issuer:    strconv.FormatInt(cfg.AppID, 10),
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(key)
+}
+
+// acquireInstallationToken mints (or refreshes) an installation access token
+// for appConfig's installation and builds a *github.Client authenticated
+// with it, storing the client and the token's expiry on appConfig. It
+// schedules its own refresh shortly
+// before the token expires.
+func (g *Github) acquireInstallationToken(appConfig *githubApp) error {
+	cfg := appConfig.config
+
+	appJWT, err := signedAppJWT(cfg)
+	if err != nil {
+		return err
+	}
+
+	reqURL := fmt.Sprintf("%s/app/installations/%d/access_tokens", cfg.apiBaseURL(), cfg.InstallationID)
+	req, err := http.NewRequest("POST", reqURL, bytes.NewReader(nil))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+appJWT)
+	req.Header.Set("Accept", "application/vnd.github.machine-man-preview+json")
+
+	resp, err := cfg.httpClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("couldn't reach github to mint installation token: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("github rejected installation token request (%d): %s", resp.StatusCode, body)
+	}
+
+	var tokenResp struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return fmt.Errorf("couldn't decode installation token response: %s", err)
+	}
+
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, cfg.httpClient())
+	ts := oauth2.StaticTokenSource(&oauth2.Token{AccessToken: tokenResp.Token})
+	tc := oauth2.NewClient(ctx, ts)
+
+	var client *github.Client
+	if cfg.isEnterprise() {
+		client, err = github.NewEnterpriseClient(cfg.apiBaseURL(), cfg.uploadBaseURL(), tc)
+		if err != nil {
+			return fmt.Errorf("couldn't build enterprise client for %s: %s", cfg.URL, err)
+		}
+	} else {
+		client = github.NewClient(tc)
+	}
+
+	refreshIn := time.Until(tokenResp.ExpiresAt) - installationTokenRefreshSkew
+	if refreshIn < 0 {
+		refreshIn = 0
+	}
+
+	appConfig.clientMu.Lock()
+	appConfig.client = client
+	appConfig.installationExpiry = tokenResp.ExpiresAt
+	if appConfig.installationRefresh != nil {
+		appConfig.installationRefresh.Stop()
+	}
+	appConfig.installationRefresh = time.AfterFunc(refreshIn, func() {
+		if err := g.acquireInstallationToken(appConfig); err != nil {
+			logcritf("(%s) couldn't refresh installation token: %s", appConfig.app.Name(), err)
+		}
+	})
+	appConfig.clientMu.Unlock()
+
+	return nil
+}
+
+// clientFor returns the *github.Client that should be used for appConfig:
+// its own installation client when it authenticates as a GitHub App, or the
+// shared OAuth2 client otherwise.
+func (g *Github) clientFor(appConfig *githubApp) *github.Client {
+	if client := appConfig.getClient(); client != nil {
+		return client
+	}
+	return g.client
 }
 
 func (g *Github) init(app core.App) {
@@ -151,11 +479,20 @@ func (g *Github) init(app core.App) {
 		} else {
 
 			g.clientHasSet.L.Lock()
-			g.acquireOauthToken()
-			for g.client == nil {
+			if err := g.acquireOauthToken(); err != nil {
+				logcritf("Couldn't authenticate with github: %s", err)
+				g.clientHasSet.L.Unlock()
+				return
+			}
+			for g.client == nil && g.clientErr == nil {
 				fmt.Println("Waiting for github authentication response...")
 				g.clientHasSet.Wait()
 			}
+			if g.clientErr != nil {
+				logcritf("Couldn't authenticate with github: %s", g.clientErr)
+				g.clientHasSet.L.Unlock()
+				return
+			}
 			fmt.Println("Got authentication response")
 			if repos, _, err := g.client.Repositories.List("", nil); err != nil {
 				logcritf("Couldn't get repos list after authenticating, something has gone wrong, clear cache and retry")
@@ -182,7 +519,6 @@ func (g *Github) init(app core.App) {
 func (g *Github) AttachToApp(app core.App) error {
 	g.m.Lock()
 	defer g.m.Unlock()
-	g.init(app)
 
 	appConfig := &githubApp{
 		app: app,
@@ -190,14 +526,60 @@ func (g *Github) AttachToApp(app core.App) error {
 	app.Config("github", &appConfig.config)
 	g.apps[app.Name()] = appConfig
 
-	g.setupDeployKey(appConfig)
+	if appConfig.config.usesAppAuth() {
+		// GitHub App installations are granted repository permissions
+		// directly, there is nothing for a deploy key to add.
+		if err := g.acquireInstallationToken(appConfig); err != nil {
+			logcritf("(%s) couldn't authenticate as installation %d: %s", app.Name(), appConfig.config.InstallationID, err)
+			return err
+		}
+	} else {
+		g.init(app)
+		g.setupDeployKey(appConfig)
+	}
+
 	g.setupHooks(appConfig)
 
 	app.Listen(core.SignalBuildProvisioning, g.onBuildStarted)
 	app.Listen(core.SignalBuildComplete, g.onBuildFinished)
+
+	// Re-apply this app's "github" config whenever ngbuild.json or its own
+	// apps/<name>/config.json changes on disk, so edits take effect without
+	// a restart.
+	reloadablePaths := map[string]bool{
+		"ngbuild.json": true,
+		filepath.Join("apps", app.Name(), "config.json"): true,
+	}
+	core.OnConfigReloaded(func(path string) {
+		if reloadablePaths[path] {
+			g.onConfigReloaded(appConfig)
+		}
+	})
+
 	return nil
 }
 
+// onConfigReloaded re-reads appConfig's "github" config block after
+// core reports that its backing config file changed on disk.
+func (g *Github) onConfigReloaded(appConfig *githubApp) {
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	oldAppID, oldInstallationID, oldPrivateKeyPath := appConfig.config.AppID, appConfig.config.InstallationID, appConfig.config.PrivateKeyPath
+
+	appConfig.app.Config("github", &appConfig.config)
+
+	installationChanged := appConfig.config.AppID != oldAppID ||
+		appConfig.config.InstallationID != oldInstallationID ||
+		appConfig.config.PrivateKeyPath != oldPrivateKeyPath
+
+	if appConfig.config.usesAppAuth() && (appConfig.getClient() == nil || installationChanged) {
+		if err := g.acquireInstallationToken(appConfig); err != nil {
+			logcritf("(%s) couldn't authenticate as installation %d after config reload: %s", appConfig.app.Name(), appConfig.config.InstallationID, err)
+		}
+	}
+}
+
 func (g *Github) setupDeployKey(appConfig *githubApp) error {
 	cfg := appConfig.config
 	// TODO - would be nicer to generate ssh key automatically
@@ -207,7 +589,7 @@ func (g *Github) setupDeployKey(appConfig *githubApp) error {
 	}
 
 	keyName := fmt.Sprintf("NGBuild ssh deploy key - %s", appConfig.app.Name())
-	_, _, err := g.client.Repositories.CreateKey(cfg.Owner, cfg.Repo, &github.Key{
+	_, _, err := g.clientFor(appConfig).Repositories.CreateKey(cfg.Owner, cfg.Repo, &github.Key{
 		Title:    &keyName,
 		Key:      &cfg.PublicKey,
 		ReadOnly: &[]bool{true}[0],
@@ -223,20 +605,28 @@ func (g *Github) setupDeployKey(appConfig *githubApp) error {
 
 func (g *Github) setupHooks(appConfig *githubApp) {
 	cfg := appConfig.config
-	_, _, err := g.client.Repositories.Get(cfg.Owner, cfg.Repo)
+	client := g.clientFor(appConfig)
+	_, _, err := client.Repositories.Get(cfg.Owner, cfg.Repo)
 	if err != nil {
 		logwarnf("(%s) Repository does not exist, owner=%s, repo=%s", appConfig.app.Name(), cfg.Owner, cfg.Repo)
 		return
 	}
 
 	hookURL := fmt.Sprintf("%s/cb/github/hook/%s", core.GetHTTPServerURL(), appConfig.app.Name())
-	_, _, err = g.client.Repositories.CreateHook(cfg.Owner, cfg.Repo, &github.Hook{
+	hookConfig := map[string]interface{}{
+		"url":          hookURL,
+		"content_type": "json",
+	}
+	if cfg.WebhookSecret != "" {
+		hookConfig["secret"] = cfg.WebhookSecret
+	} else {
+		logwarnf("(%s) no webhookSecret configured, webhook deliveries will be accepted unsigned", appConfig.app.Name())
+	}
+
+	_, _, err = client.Repositories.CreateHook(cfg.Owner, cfg.Repo, &github.Hook{
 		Name:   &[]string{"web"}[0],
 		Active: &[]bool{true}[0],
-		Config: map[string]interface{}{
-			"url":          hookURL,
-			"content_type": "json",
-		},
+		Config: hookConfig,
 		Events: []string{"pull_request",
 			"delete",
 			"issue_comment",
@@ -299,7 +689,7 @@ func (g *Github) trackPullRequest(app *githubApp, event *github.PullRequestEvent
 	owner := *pull.Base.Repo.Owner.Login
 	repo := *pull.Base.Repo.Name
 	user := *pull.User.Login
-	isCollaborator, _, err := g.client.Repositories.IsCollaborator(owner, repo, user)
+	isCollaborator, _, err := g.clientFor(app).Repositories.IsCollaborator(owner, repo, user)
 	if err != nil {
 		logcritf("Couldn't check collaborator status on %s: %s", pullID, err)
 		return
@@ -331,7 +721,7 @@ func (g *Github) buildPullRequest(app *githubApp, pull *github.PullRequest) {
 	loginfof("Building pull request: %s", pullID)
 	status, ok := g.trackedPullRequests[pullID]
 	if ok == false {
-		status = pullRequestStatus{pull, "", false}
+		status = pullRequestStatus{pull: pull}
 		g.trackedPullRequests[pullID] = status
 	}
 
@@ -374,6 +764,7 @@ func (g *Github) buildPullRequest(app *githubApp, pull *github.PullRequest) {
 	buildConfig.Group = pullID
 
 	buildConfig.SetMetadata("github:BuildType", "pullrequest")
+	buildConfig.SetMetadata("github:AppName", app.app.Name())
 	buildConfig.SetMetadata("github:PullRequestID", pullID)
 	buildConfig.SetMetadata("github:PullNumber", fmt.Sprintf("%d", *pull.Number))
 	buildConfig.SetMetadata("github:HeadHash", headCommit)
@@ -435,6 +826,481 @@ func (g *Github) closedPullRequest(app *githubApp, event *github.PullRequestEven
 	delete(g.trackedPullRequests, pullID)
 }
 
+// handleGithubEvent is the webhook endpoint registered per-app at
+// /cb/github/hook/<appname>. It parses the payload according to its
+// X-Github-Event header and dispatches to the relevant handler.
+func (g *Github) handleGithubEvent(resp http.ResponseWriter, req *http.Request) {
+	appName := strings.TrimPrefix(req.URL.Path, "/cb/github/hook/")
+
+	g.m.RLock()
+	appConfig, ok := g.apps[appName]
+	g.m.RUnlock()
+	if ok == false {
+		logwarnf("webhook event for unknown app: %s", appName)
+		resp.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		logwarnf("(%s) couldn't read webhook body: %s", appName, err)
+		resp.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if appConfig.config.WebhookSecret != "" {
+		if verifyWebhookSignature(appConfig.config.WebhookSecret, body, req.Header.Get("X-Hub-Signature-256")) == false {
+			logwarnf("(%s) rejecting webhook delivery with invalid signature", appName)
+			resp.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+
+	if g.recentDeliveries.seenBefore(req.Header.Get("X-GitHub-Delivery")) {
+		loginfof("(%s) dropping replayed webhook delivery", appName)
+		resp.WriteHeader(http.StatusOK)
+		return
+	}
+
+	event, err := github.ParseWebHook(github.WebHookType(req), body)
+	if err != nil {
+		logwarnf("(%s) couldn't parse webhook payload: %s", appName, err)
+		resp.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	switch event := event.(type) {
+	case *github.PullRequestEvent:
+		g.handlePullRequestEvent(appConfig, event)
+	case *github.IssueCommentEvent:
+		g.handleIssueCommentEvent(appConfig, event)
+	case *github.PullRequestReviewEvent:
+		g.handlePullRequestReviewEvent(appConfig, event)
+	case *github.PushEvent:
+		g.handlePushEvent(appConfig, event)
+	default:
+		loginfof("(%s) ignoring unhandled webhook event %T", appName, event)
+	}
+
+	resp.WriteHeader(http.StatusOK)
+}
+
+func (g *Github) handlePullRequestEvent(app *githubApp, event *github.PullRequestEvent) {
+	if event.Action == nil {
+		return
+	}
+
+	switch *event.Action {
+	case "opened", "reopened":
+		g.trackPullRequest(app, event)
+	case "synchronize":
+		g.updatePullRequest(app, event)
+	case "closed":
+		g.closedPullRequest(app, event)
+	}
+}
+
+// handleIssueCommentEvent arms merge-on-pass when a collaborator comments on
+// a pull request with one of MergeOnPassAuthWords.
+func (g *Github) handleIssueCommentEvent(app *githubApp, event *github.IssueCommentEvent) {
+	if event.Action == nil || *event.Action != "created" {
+		return
+	}
+	if event.Issue == nil || event.Issue.PullRequestLinks == nil || event.Comment == nil {
+		return // plain issue comment, not a pull request
+	}
+
+	owner := *event.Repo.Owner.Login
+	repo := *event.Repo.Name
+	commenter := *event.Comment.User.Login
+
+	isCollaborator, _, err := g.clientFor(app).Repositories.IsCollaborator(owner, repo, commenter)
+	if err != nil {
+		logcritf("(%s) couldn't check collaborator status for %s: %s", app.app.Name(), commenter, err)
+		return
+	} else if isCollaborator == false {
+		logwarnf("(%s) ignoring merge-on-pass comment from non-collaborator: %s", app.app.Name(), commenter)
+		return
+	}
+
+	if matchesAuthWord(*event.Comment.Body, app.config.MergeOnPassAuthWords) == false {
+		return
+	}
+
+	if event.Issue.Number == nil {
+		return
+	}
+
+	pullID, ok := g.pullIDForNumber(*event.Issue.Number)
+	if ok == false {
+		logwarnf("(%s) merge-on-pass auth word from %s on untracked/ignored pull #%d", app.app.Name(), commenter, *event.Issue.Number)
+		return
+	}
+
+	g.armMergeOnPass(app, pullID, commenter)
+}
+
+// pullIDForNumber finds the tracked pull request ID (the key into
+// trackedPullRequests, which is *github.PullRequest.ID) for a pull request
+// by its number. Issue comment webhooks only carry the issue's own ID,
+// which GitHub allocates separately from the pull request's ID even though
+// every pull request is also an issue, so issue_comment handling has to go
+// through the number instead.
+func (g *Github) pullIDForNumber(number int) (string, bool) {
+	g.m.RLock()
+	defer g.m.RUnlock()
+
+	for pullID, status := range g.trackedPullRequests {
+		if status.pull != nil && status.pull.Number != nil && *status.pull.Number == number {
+			return pullID, true
+		}
+	}
+	return "", false
+}
+
+// handlePullRequestReviewEvent arms merge-on-pass when a collaborator
+// submits a review whose body contains one of MergeOnPassAuthWords.
+func (g *Github) handlePullRequestReviewEvent(app *githubApp, event *github.PullRequestReviewEvent) {
+	if event.Action == nil || *event.Action != "submitted" {
+		return
+	}
+	if event.Review == nil || event.PullRequest == nil {
+		return
+	}
+
+	owner := *event.PullRequest.Base.Repo.Owner.Login
+	repo := *event.PullRequest.Base.Repo.Name
+	reviewer := *event.Review.User.Login
+
+	isCollaborator, _, err := g.clientFor(app).Repositories.IsCollaborator(owner, repo, reviewer)
+	if err != nil {
+		logcritf("(%s) couldn't check collaborator status for %s: %s", app.app.Name(), reviewer, err)
+		return
+	} else if isCollaborator == false {
+		logwarnf("(%s) ignoring review from non-collaborator: %s", app.app.Name(), reviewer)
+		return
+	}
+
+	body := ""
+	if event.Review.Body != nil {
+		body = *event.Review.Body
+	}
+	if matchesAuthWord(body, app.config.MergeOnPassAuthWords) == false {
+		return
+	}
+
+	g.armMergeOnPass(app, strconv.Itoa(*event.PullRequest.ID), reviewer)
+}
+
+// agitRefPrefix marks a pushed ref as an agit-style ad-hoc pull request:
+// "refs/for/<target-branch>[/<topic>]".
+const agitRefPrefix = "refs/for/"
+
+// handlePushEvent recognizes agit-style "push to refs/for/<branch>" pushes
+// and builds them as ephemeral, PR-less pull requests. Ordinary branch
+// pushes are ignored; branch builds are driven entirely through pull
+// requests elsewhere in this file.
+func (g *Github) handlePushEvent(app *githubApp, event *github.PushEvent) {
+	ref := *event.Ref
+	if strings.HasPrefix(ref, agitRefPrefix) == false {
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(ref, agitRefPrefix), "/", 2)
+	targetBranch := parts[0]
+	topic := ""
+	if len(parts) == 2 {
+		topic = parts[1]
+	}
+
+	cfg := app.config
+	for _, ignored := range cfg.IgnoredBranches {
+		if ignored == targetBranch {
+			logwarnf("(%s) ignoring agit push to ignored branch %s", app.app.Name(), targetBranch)
+			return
+		}
+	}
+
+	pusher := *event.Pusher.Name
+	headCommit := *event.After
+	group := agitGroup(pusher, topic, targetBranch)
+
+	// GitHub's webhook payload doesn't surface git push options, so
+	// "-o topic=" is only honoured via the refs/for/<branch>/<topic> path
+	// form above; there is nothing further to read here.
+
+	g.m.Lock()
+	if buildToken, ok := g.agitBuilds[group]; ok {
+		if build, _ := app.app.GetBuild(buildToken); build != nil {
+			if build.Config().GetMetadata("github:HeadHash") == headCommit {
+				g.m.Unlock()
+				logwarnf("(%s) already building/built this agit commit", app.app.Name())
+				return
+			}
+			if cfg.CancelOnNewCommit {
+				build.Stop()
+			}
+		}
+	}
+	g.m.Unlock()
+
+	buildConfig := core.NewBuildConfig()
+	buildConfig.Title = fmt.Sprintf("agit: %s -> %s", pusher, targetBranch)
+	buildConfig.HeadRepo = *event.Repo.SSHURL
+	buildConfig.HeadBranch = ref
+	buildConfig.HeadHash = headCommit
+
+	buildConfig.BaseRepo = *event.Repo.SSHURL
+	buildConfig.BaseBranch = targetBranch
+	buildConfig.BaseHash = ""
+
+	buildConfig.Group = group
+
+	buildConfig.SetMetadata("github:BuildType", "agit")
+	buildConfig.SetMetadata("github:AppName", app.app.Name())
+	buildConfig.SetMetadata("github:HeadOwner", cfg.Owner)
+	buildConfig.SetMetadata("github:HeadRepo", cfg.Repo)
+	buildConfig.SetMetadata("github:HeadHash", headCommit)
+	if topic != "" {
+		buildConfig.SetMetadata("github:AgitTopic", topic)
+	}
+
+	buildToken, err := app.app.NewBuild(group, buildConfig)
+	if err != nil {
+		logcritf("(%s) couldn't start agit build for %s: %s", app.app.Name(), ref, err)
+		return
+	}
+
+	g.m.Lock()
+	g.agitBuilds[group] = buildToken
+	g.m.Unlock()
+
+	loginfof("(%s) started agit build: %s", app.app.Name(), buildToken)
+}
+
+// agitGroup deterministically derives a build group for an agit push so
+// repeated pushes from the same pusher, to the same topic and target
+// branch, land in the same group and can cancel one another.
+func agitGroup(pusher, topic, target string) string {
+	sum := sha1.Sum([]byte(pusher + "\x00" + topic + "\x00" + target))
+	return fmt.Sprintf("agit-%x", sum[:8])
+}
+
+// armMergeOnPass flips the mergeOnPass flag for the tracked pull request
+// pullID, which onBuildFinished consults once the build passes.
+func (g *Github) armMergeOnPass(app *githubApp, pullID, actor string) {
+	g.m.Lock()
+	defer g.m.Unlock()
+
+	status, ok := g.trackedPullRequests[pullID]
+	if ok == false {
+		logwarnf("(%s) merge-on-pass auth word from %s on untracked/ignored pull %s", app.app.Name(), actor, pullID)
+		return
+	}
+
+	status.mergeOnPass = true
+	g.trackedPullRequests[pullID] = status
+	loginfof("(%s) merge-on-pass armed for pull %s by %s", app.app.Name(), pullID, actor)
+}
+
+// verifyWebhookSignature reports whether signatureHeader (the raw
+// X-Hub-Signature-256 header value) is a valid HMAC-SHA256 of body under
+// secret.
+func verifyWebhookSignature(secret string, body []byte, signatureHeader string) bool {
+	const prefix = "sha256="
+	if strings.HasPrefix(signatureHeader, prefix) == false {
+		return false
+	}
+
+	expected, err := hex.DecodeString(strings.TrimPrefix(signatureHeader, prefix))
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+func matchesAuthWord(body string, words []string) bool {
+	for _, word := range words {
+		if strings.Contains(body, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// appForBuild looks up the githubApp that provisioned build, using the
+// github:AppName metadata stamped on it in buildPullRequest.
+func (g *Github) appForBuild(build core.Build) *githubApp {
+	appName := build.Config().GetMetadata("github:AppName")
+
+	g.m.RLock()
+	defer g.m.RUnlock()
+	return g.apps[appName]
+}
+
+// onBuildStarted reports a "pending" commit status for a newly provisioned
+// build.
+func (g *Github) onBuildStarted(build core.Build) {
+	g.m.Lock()
+	g.trackBuild(build)
+	g.m.Unlock()
+
+	g.reportStatus(build, "pending", "Build started")
+}
+
+// buildFinishedStatus maps a finished build's error and log output onto a
+// GitHub commit status state and description. A build that produced no log
+// output never actually ran the job, so it's reported as "error" (something
+// went wrong setting the build up) rather than "failure" (the job ran and
+// its steps didn't pass); core.Build doesn't currently expose a more direct
+// signal than this to distinguish the two.
+func buildFinishedStatus(buildErr error, log string) (state, description string) {
+	if buildErr == nil {
+		return "success", "Build passed"
+	}
+	if strings.TrimSpace(log) == "" {
+		return "error", "Build errored"
+	}
+	return "failure", "Build failed"
+}
+
+// onBuildFinished reports the final commit status for a completed build and,
+// on failure, leaves a comment on the pull request with the tail of the
+// build log so reviewers don't need to dig through ngbuild to see why.
+func (g *Github) onBuildFinished(build core.Build) {
+	g.m.Lock()
+	g.untrackBuild(build)
+	g.m.Unlock()
+
+	state, description := buildFinishedStatus(build.Error(), build.Log())
+
+	g.reportStatus(build, state, description)
+
+	if state != "success" {
+		g.postFailureComment(build)
+	} else {
+		g.mergeIfArmed(build)
+	}
+}
+
+// mergeIfArmed merges build's pull request if a collaborator previously
+// armed merge-on-pass for it, via a comment or review matching one of
+// MergeOnPassAuthWords.
+func (g *Github) mergeIfArmed(build core.Build) {
+	appConfig := g.appForBuild(build)
+	if appConfig == nil {
+		return
+	}
+
+	pullID := build.Config().GetMetadata("github:PullRequestID")
+
+	g.m.Lock()
+	status, ok := g.trackedPullRequests[pullID]
+	g.m.Unlock()
+	if ok == false || status.mergeOnPass == false {
+		return
+	}
+
+	pullNumber, err := strconv.Atoi(build.Config().GetMetadata("github:PullNumber"))
+	if err != nil {
+		logwarnf("(%s) build %s has no pull number, not merging", appConfig.app.Name(), build.Token())
+		return
+	}
+
+	cfg := appConfig.config
+	_, _, err = g.clientFor(appConfig).PullRequests.Merge(cfg.Owner, cfg.Repo, pullNumber, *status.pull.Title)
+	if err != nil {
+		logwarnf("(%s) couldn't merge pull %s on pass: %s", appConfig.app.Name(), pullID, err)
+		return
+	}
+
+	g.m.Lock()
+	delete(g.trackedPullRequests, pullID)
+	g.m.Unlock()
+}
+
+// reportStatus publishes a commit status for build's head commit, using the
+// github:HeadOwner/HeadRepo/HeadHash metadata stamped on it when the build
+// was created.
+func (g *Github) reportStatus(build core.Build, state, description string) {
+	appConfig := g.appForBuild(build)
+	if appConfig == nil {
+		logwarnf("couldn't find app for build %s, not reporting status", build.Token())
+		return
+	}
+
+	cfg := build.Config()
+	owner := cfg.GetMetadata("github:HeadOwner")
+	repo := cfg.GetMetadata("github:HeadRepo")
+	sha := cfg.GetMetadata("github:HeadHash")
+
+	statusContext := fmt.Sprintf("ngbuild/%s", appConfig.app.Name())
+	targetURL := fmt.Sprintf("%s/build/%s", core.GetHTTPServerURL(), build.Token())
+
+	_, _, err := g.clientFor(appConfig).Repositories.CreateStatus(owner, repo, sha, &github.RepoStatus{
+		State:       &state,
+		Description: &description,
+		Context:     &statusContext,
+		TargetURL:   &targetURL,
+	})
+	if err != nil {
+		logwarnf("(%s) couldn't report status for %s: %s", appConfig.app.Name(), sha, err)
+	}
+}
+
+// postFailureComment creates, or updates, a single sticky comment on the
+// pull request with the tail of build's log.
+func (g *Github) postFailureComment(build core.Build) {
+	appConfig := g.appForBuild(build)
+	if appConfig == nil {
+		return
+	}
+
+	pullID := build.Config().GetMetadata("github:PullRequestID")
+	pullNumber, err := strconv.Atoi(build.Config().GetMetadata("github:PullNumber"))
+	if err != nil {
+		logwarnf("(%s) build %s has no pull number, not commenting", appConfig.app.Name(), build.Token())
+		return
+	}
+
+	body := fmt.Sprintf("Build failed, tail of the log:\n\n```\n%s\n```", tailLog(build, buildLogTailLines))
+	client := g.clientFor(appConfig)
+	cfg := appConfig.config
+
+	g.m.Lock()
+	status, ok := g.trackedPullRequests[pullID]
+	g.m.Unlock()
+
+	if ok && status.statusCommentID != 0 {
+		_, _, err = client.Issues.EditComment(cfg.Owner, cfg.Repo, status.statusCommentID, &github.IssueComment{Body: &body})
+	} else {
+		var comment *github.IssueComment
+		comment, _, err = client.Issues.CreateComment(cfg.Owner, cfg.Repo, pullNumber, &github.IssueComment{Body: &body})
+		if err == nil && comment.ID != nil {
+			g.m.Lock()
+			status.statusCommentID = *comment.ID
+			g.trackedPullRequests[pullID] = status
+			g.m.Unlock()
+		}
+	}
+
+	if err != nil {
+		logwarnf("(%s) couldn't post failure comment on pull %s: %s", appConfig.app.Name(), pullID, err)
+	}
+}
+
+// tailLog returns the last n lines of build's log output.
+func tailLog(build core.Build, n int) string {
+	lines := strings.Split(strings.TrimRight(build.Log(), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
 func loginfof(str string, args ...interface{}) (ret string) {
 	ret = fmt.Sprintf("github-info: "+str+"\n", args...)
 	fmt.Printf(ret)
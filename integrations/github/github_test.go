@@ -0,0 +1,267 @@
+package github
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyWebhookSignature(t *testing.T) {
+	secret := "shhh"
+	body := []byte(`{"zen":"Keep it logically awesome."}`)
+
+	cases := []struct {
+		name      string
+		secret    string
+		body      []byte
+		signature string
+		want      bool
+	}{
+		{
+			name:      "valid signature",
+			secret:    secret,
+			body:      body,
+			signature: sign(secret, body),
+			want:      true,
+		},
+		{
+			name:      "missing sha256= prefix",
+			secret:    secret,
+			body:      body,
+			signature: strings.TrimPrefix(sign(secret, body), "sha256="),
+			want:      false,
+		},
+		{
+			name:      "wrong secret",
+			secret:    secret,
+			body:      body,
+			signature: sign("wrong-secret", body),
+			want:      false,
+		},
+		{
+			name:      "tampered body",
+			secret:    secret,
+			body:      []byte(`{"zen":"tampered"}`),
+			signature: sign(secret, body),
+			want:      false,
+		},
+		{
+			name:      "malformed hex",
+			secret:    secret,
+			body:      body,
+			signature: "sha256=not-hex",
+			want:      false,
+		},
+		{
+			name:      "empty header",
+			secret:    secret,
+			body:      body,
+			signature: "",
+			want:      false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := verifyWebhookSignature(c.secret, c.body, c.signature); got != c.want {
+				t.Errorf("verifyWebhookSignature(%q, %q, %q) = %v, want %v", c.secret, c.body, c.signature, got, c.want)
+			}
+		})
+	}
+}
+
+func TestDeliveryLRUSeenBefore(t *testing.T) {
+	l := newDeliveryLRU(2)
+
+	if l.seenBefore("a") {
+		t.Fatal("first delivery of \"a\" reported as already seen")
+	}
+	if l.seenBefore("a") == false {
+		t.Fatal("repeated delivery of \"a\" not recognized as seen")
+	}
+	if l.seenBefore("") {
+		t.Fatal("empty delivery ID reported as seen")
+	}
+
+	l.seenBefore("b")
+	l.seenBefore("c") // evicts "a", limit is 2
+
+	if l.seenBefore("a") {
+		t.Error("\"a\" still reported as seen after being evicted")
+	}
+}
+
+func writePEMKeyFile(t *testing.T, dir, name, blockType string, der []byte) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	pemBytes := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := ioutil.WriteFile(path, pemBytes, 0600); err != nil {
+		t.Fatalf("couldn't write %s: %s", path, err)
+	}
+	return path
+}
+
+func TestSignedAppJWT(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("couldn't generate RSA key: %s", err)
+	}
+
+	pkcs8DER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("couldn't marshal PKCS8 key: %s", err)
+	}
+
+	dir := t.TempDir()
+	pkcs1Path := writePEMKeyFile(t, dir, "pkcs1.pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key))
+	pkcs8Path := writePEMKeyFile(t, dir, "pkcs8.pem", "PRIVATE KEY", pkcs8DER)
+	notPEMPath := filepath.Join(dir, "not-pem.pem")
+	if err := ioutil.WriteFile(notPEMPath, []byte("not a PEM block"), 0600); err != nil {
+		t.Fatalf("couldn't write %s: %s", notPEMPath, err)
+	}
+
+	checkValid := func(t *testing.T, token string) {
+		t.Helper()
+		parsed, err := jwt.Parse(token, func(*jwt.Token) (interface{}, error) {
+			return &key.PublicKey, nil
+		})
+		if err != nil {
+			t.Fatalf("signed JWT didn't parse/verify: %s", err)
+		}
+		claims, ok := parsed.Claims.(jwt.MapClaims)
+		if ok == false {
+			t.Fatal("unexpected claims type")
+		}
+		if claims["iss"] != "42" {
+			t.Errorf("iss claim = %v, want %q", claims["iss"], "42")
+		}
+	}
+
+	t.Run("PKCS1 key", func(t *testing.T) {
+		token, err := signedAppJWT(githubConfig{AppID: 42, PrivateKeyPath: pkcs1Path})
+		if err != nil {
+			t.Fatalf("signedAppJWT: %s", err)
+		}
+		checkValid(t, token)
+	})
+
+	t.Run("PKCS8 key", func(t *testing.T) {
+		token, err := signedAppJWT(githubConfig{AppID: 42, PrivateKeyPath: pkcs8Path})
+		if err != nil {
+			t.Fatalf("signedAppJWT: %s", err)
+		}
+		checkValid(t, token)
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		_, err := signedAppJWT(githubConfig{AppID: 42, PrivateKeyPath: filepath.Join(dir, "missing.pem")})
+		if err == nil {
+			t.Fatal("expected an error for a missing private key file")
+		}
+	})
+
+	t.Run("not a PEM block", func(t *testing.T) {
+		_, err := signedAppJWT(githubConfig{AppID: 42, PrivateKeyPath: notPEMPath})
+		if err == nil || strings.Contains(err.Error(), "PEM block") == false {
+			t.Fatalf("expected a PEM-block error, got: %v", err)
+		}
+	})
+
+	t.Run("non-RSA PKCS8 key", func(t *testing.T) {
+		ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("couldn't generate EC key: %s", err)
+		}
+		ecDER, err := x509.MarshalPKCS8PrivateKey(ecKey)
+		if err != nil {
+			t.Fatalf("couldn't marshal EC key: %s", err)
+		}
+		path := writePEMKeyFile(t, dir, "ec.pem", "PRIVATE KEY", ecDER)
+
+		_, err = signedAppJWT(githubConfig{AppID: 42, PrivateKeyPath: path})
+		if err == nil {
+			t.Fatal("expected an error for a non-RSA PKCS8 key")
+		}
+	})
+}
+
+func TestBuildFinishedStatus(t *testing.T) {
+	cases := []struct {
+		name            string
+		err             error
+		log             string
+		wantState       string
+		wantDescription string
+	}{
+		{
+			name:            "no error is success",
+			err:             nil,
+			log:             "running tests...\nok\n",
+			wantState:       "success",
+			wantDescription: "Build passed",
+		},
+		{
+			name:            "error with log output is a failure",
+			err:             errors.New("exit status 1"),
+			log:             "running tests...\nFAIL\n",
+			wantState:       "failure",
+			wantDescription: "Build failed",
+		},
+		{
+			name:            "error with no log output is an error",
+			err:             errors.New("couldn't provision build"),
+			log:             "",
+			wantState:       "error",
+			wantDescription: "Build errored",
+		},
+		{
+			name:            "error with whitespace-only log output is an error",
+			err:             errors.New("couldn't provision build"),
+			log:             "\n  \n",
+			wantState:       "error",
+			wantDescription: "Build errored",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			state, description := buildFinishedStatus(c.err, c.log)
+			if state != c.wantState || description != c.wantDescription {
+				t.Errorf("buildFinishedStatus(%v, %q) = (%q, %q), want (%q, %q)",
+					c.err, c.log, state, description, c.wantState, c.wantDescription)
+			}
+		})
+	}
+}
+
+func TestAgitGroup(t *testing.T) {
+	a := agitGroup("alice", "my-topic", "main")
+	b := agitGroup("alice", "my-topic", "main")
+	if a != b {
+		t.Errorf("agitGroup is not deterministic: %q != %q", a, b)
+	}
+
+	if c := agitGroup("bob", "my-topic", "main"); c == a {
+		t.Error("agitGroup collided across different pushers")
+	}
+}